@@ -0,0 +1,169 @@
+package pewpew
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"sync"
+
+	"github.com/rtk4616/pewpew/lib/httpcache"
+)
+
+//cacheStatusHeader carries a request's cache outcome ("hit", "miss", or
+//"revalidated") from the transport back up to the worker loop, since
+//runRequest has no other way to see it.
+const cacheStatusHeader = "X-Pewpew-Cache-Status"
+
+//cacheBytesSavedHeader carries the body size (in bytes) a "revalidated"
+//response saved by not being re-downloaded, since the 304 itself has no
+//body for runRequest to measure.
+const cacheBytesSavedHeader = "X-Pewpew-Cache-Bytes-Saved"
+
+//validators are the cache-validation headers captured from a URL's first
+//response, used to make subsequent requests conditional.
+type validators struct {
+	ETag         string
+	LastModified string
+	//BodySize is the full response's Content-Length, or -1 if the origin
+	//didn't send one (e.g. chunked) and the saving on revalidation can't
+	//be measured without buffering the body.
+	BodySize int64
+}
+
+//cachingRoundTripper wraps a target's transport to support UseConditional
+//(conditional GETs validated against the origin) and SharedCache (an
+//in-process LRU that serves repeat requests locally) modes.
+type cachingRoundTripper struct {
+	next http.RoundTripper
+
+	useConditional bool
+	cacheValidation string //"etag", "last-modified", or "" for both
+
+	sharedCache *httpcache.LRU
+
+	mu         sync.Mutex
+	validators map[string]validators //keyed by request URL
+}
+
+func newCachingRoundTripper(next http.RoundTripper, t Target) *cachingRoundTripper {
+	rt := &cachingRoundTripper{
+		next:            next,
+		useConditional:  t.UseConditional,
+		cacheValidation: t.CacheValidation,
+		validators:      make(map[string]validators),
+	}
+	if t.SharedCache {
+		rt.sharedCache = httpcache.New(t.CacheCapacity)
+	}
+	return rt
+}
+
+//cacheableStatus reports whether a response's status code is safe to
+//replay verbatim to a later request, so a cached 4xx/5xx (or a cached
+//response to a non-idempotent method) is never served as a "hit".
+func cacheableStatus(code int) bool {
+	return code >= 200 && code < 300
+}
+
+func (c *cachingRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	key := req.URL.String()
+
+	if c.sharedCache != nil && req.Method == http.MethodGet {
+		if entry, ok := c.sharedCache.Get(key); ok {
+			return c.servedFromCache(req, entry), nil
+		}
+	}
+
+	var v validators
+	if c.useConditional {
+		c.mu.Lock()
+		v = c.validators[key]
+		c.mu.Unlock()
+		if v.ETag != "" && c.cacheValidation != "last-modified" {
+			req.Header.Set("If-None-Match", v.ETag)
+		}
+		if v.LastModified != "" && c.cacheValidation != "etag" {
+			req.Header.Set("If-Modified-Since", v.LastModified)
+		}
+	}
+
+	resp, err := c.next.RoundTrip(req)
+	if err != nil {
+		return resp, err
+	}
+
+	if resp.StatusCode == http.StatusNotModified {
+		resp.Header.Set(cacheStatusHeader, "revalidated")
+		if v.BodySize >= 0 {
+			resp.Header.Set(cacheBytesSavedHeader, strconv.FormatInt(v.BodySize, 10))
+		}
+		return resp, nil
+	}
+
+	if c.useConditional {
+		c.mu.Lock()
+		c.validators[key] = validators{
+			ETag:         resp.Header.Get("ETag"),
+			LastModified: resp.Header.Get("Last-Modified"),
+			BodySize:     resp.ContentLength,
+		}
+		c.mu.Unlock()
+	}
+
+	if c.sharedCache != nil && req.Method == http.MethodGet && cacheableStatus(resp.StatusCode) {
+		body, err := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			return resp, err
+		}
+		resp.Body = ioutil.NopCloser(bytes.NewReader(body))
+		c.sharedCache.Set(key, httpcache.Entry{
+			StatusCode: resp.StatusCode,
+			Header:     map[string][]string(resp.Header),
+			Body:       body,
+		})
+	}
+
+	resp.Header.Set(cacheStatusHeader, "miss")
+	return resp, nil
+}
+
+//servedFromCache builds a synthetic response from a SharedCache hit,
+//without making a network request.
+func (c *cachingRoundTripper) servedFromCache(req *http.Request, entry httpcache.Entry) *http.Response {
+	header := make(http.Header, len(entry.Header))
+	for k, v := range entry.Header {
+		header[k] = v
+	}
+	header.Set(cacheStatusHeader, "hit")
+	return &http.Response{
+		Status:        http.StatusText(entry.StatusCode),
+		StatusCode:    entry.StatusCode,
+		Header:        header,
+		Body:          ioutil.NopCloser(bytes.NewReader(entry.Body)),
+		ContentLength: int64(len(entry.Body)),
+		Request:       req,
+	}
+}
+
+//cachingEnabled reports whether a target wants any caching/conditional behavior
+//wrapped around its transport.
+func cachingEnabled(t Target) bool {
+	return t.UseConditional || t.SharedCache
+}
+
+//cacheStatusFromResponse reads cachingRoundTripper's per-response headers
+//back off of resp, for callers (runRequest, runRequestWithRetry) to copy
+//onto a requestStat. bytesSaved is -1 when resp wasn't revalidated, or
+//when it was but the prior response's size wasn't known.
+func cacheStatusFromResponse(resp *http.Response) (status string, bytesSaved int64) {
+	status = resp.Header.Get(cacheStatusHeader)
+	bytesSaved = int64(-1)
+	if raw := resp.Header.Get(cacheBytesSavedHeader); raw != "" {
+		if n, err := strconv.ParseInt(raw, 10, 64); err == nil {
+			bytesSaved = n
+		}
+	}
+	return status, bytesSaved
+}
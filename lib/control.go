@@ -0,0 +1,49 @@
+package pewpew
+
+import (
+	"context"
+	"net/http"
+	"sync/atomic"
+)
+
+//newControlServer builds the opt-in control endpoint for a running stress
+//test. cancel stops the run; restarted/paused are shared flags the run
+//loop polls, set here via atomic so the HTTP handlers (which run on
+//their own goroutines) and the workers can touch them safely.
+func newControlServer(cancel context.CancelFunc, restarted, paused *int32) *http.Server {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/stop", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "", http.StatusMethodNotAllowed)
+			return
+		}
+		cancel()
+		w.Write([]byte("stopping\n"))
+	})
+	mux.HandleFunc("/pause", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "", http.StatusMethodNotAllowed)
+			return
+		}
+		atomic.StoreInt32(paused, 1)
+		w.Write([]byte("paused\n"))
+	})
+	mux.HandleFunc("/resume", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "", http.StatusMethodNotAllowed)
+			return
+		}
+		atomic.StoreInt32(paused, 0)
+		w.Write([]byte("resumed\n"))
+	})
+	mux.HandleFunc("/restart", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "", http.StatusMethodNotAllowed)
+			return
+		}
+		atomic.StoreInt32(restarted, 1)
+		cancel()
+		w.Write([]byte("restarting\n"))
+	})
+	return &http.Server{Handler: mux}
+}
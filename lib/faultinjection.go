@@ -0,0 +1,172 @@
+package pewpew
+
+import (
+	"io"
+	"math"
+	"math/rand"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+//FaultInjection wraps a target's transport with synthetic unreliability,
+//so a test can validate that a client under test tolerates flaky
+//upstreams, or exercise pewpew itself against known error rates.
+type FaultInjection struct {
+	//DropRate is the fraction (0-1) of requests that fail before ever
+	//reaching the network, with a synthetic connection error.
+	DropRate float64
+
+	//LatencyDistribution is "fixed", "uniform", or "exponential".
+	//Empty means no added latency.
+	LatencyDistribution string
+	//LatencyMean is the added latency for "fixed" and "exponential",
+	//and the midpoint for "uniform".
+	LatencyMean time.Duration
+	//LatencyJitter is the +/- range around LatencyMean for "uniform".
+	//Unused for "fixed" and "exponential".
+	LatencyJitter time.Duration
+
+	//ForcedStatusRate maps an HTTP status code to the fraction (0-1) of
+	//requests that should have their real response status overwritten
+	//with it. Rates for a single target should sum to <= 1.
+	ForcedStatusRate map[int]float64
+
+	//TruncateBytes, if > 0, cuts every response body off after this many
+	//bytes.
+	TruncateBytes int64
+
+	//Seed makes the injected faults reproducible across runs. Zero uses
+	//a time-seeded source instead.
+	Seed int64
+}
+
+//enabled reports whether fi describes any actual fault behavior, so
+//RunStress can skip wrapping the transport when it's the zero value.
+func (fi FaultInjection) enabled() bool {
+	return fi.DropRate > 0 || fi.LatencyDistribution != "" ||
+		len(fi.ForcedStatusRate) > 0 || fi.TruncateBytes > 0
+}
+
+//faultRoundTripper wraps an http.RoundTripper, injecting drops, latency,
+//forced statuses, and body truncation according to its FaultInjection
+//config.
+type faultRoundTripper struct {
+	next http.RoundTripper
+	fi   FaultInjection
+
+	mu  sync.Mutex
+	rng *rand.Rand
+}
+
+func newFaultRoundTripper(next http.RoundTripper, fi FaultInjection) *faultRoundTripper {
+	seed := fi.Seed
+	if seed == 0 {
+		seed = time.Now().UnixNano()
+	}
+	return &faultRoundTripper{
+		next: next,
+		fi:   fi,
+		rng:  rand.New(rand.NewSource(seed)),
+	}
+}
+
+//dropConnError is returned in place of an actual connection error when
+//DropRate injects a synthetic failure.
+type dropConnError struct{}
+
+func (dropConnError) Error() string { return "fault injection: connection dropped" }
+
+func (f *faultRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	f.mu.Lock()
+	drop := f.fi.DropRate > 0 && f.rng.Float64() < f.fi.DropRate
+	latency := f.latency()
+	forcedStatus, forceStatus := f.forcedStatus()
+	f.mu.Unlock()
+
+	if latency > 0 {
+		time.Sleep(latency)
+	}
+	if drop {
+		return nil, dropConnError{}
+	}
+
+	resp, err := f.next.RoundTrip(req)
+	if err != nil {
+		return resp, err
+	}
+
+	if forceStatus {
+		resp.Status = http.StatusText(forcedStatus)
+		resp.StatusCode = forcedStatus
+	}
+	if f.fi.TruncateBytes > 0 {
+		resp.Body = truncatedBody{
+			Reader: io.LimitReader(resp.Body, f.fi.TruncateBytes),
+			closer: resp.Body,
+		}
+	}
+	return resp, nil
+}
+
+//latency rolls the added delay for this request. Caller must hold f.mu.
+func (f *faultRoundTripper) latency() time.Duration {
+	switch f.fi.LatencyDistribution {
+	case "fixed":
+		return f.fi.LatencyMean
+	case "uniform":
+		if f.fi.LatencyJitter <= 0 {
+			return f.fi.LatencyMean
+		}
+		offset := time.Duration(f.rng.Int63n(int64(2*f.fi.LatencyJitter))) - f.fi.LatencyJitter
+		return f.fi.LatencyMean + offset
+	case "exponential":
+		if f.fi.LatencyMean <= 0 {
+			return 0
+		}
+		//inverse transform sampling for an exponential distribution with
+		//the configured mean
+		return time.Duration(-math.Log(1-f.rng.Float64()) * float64(f.fi.LatencyMean))
+	default:
+		return 0
+	}
+}
+
+//forcedStatus rolls whether this request's response status should be
+//overwritten, and with what. Caller must hold f.mu.
+func (f *faultRoundTripper) forcedStatus() (int, bool) {
+	if len(f.fi.ForcedStatusRate) == 0 {
+		return 0, false
+	}
+	//map iteration order is randomized, so range directly over
+	//ForcedStatusRate would make the cumulative-threshold walk (and thus
+	//the status a given roll maps to) vary run-to-run even with the same
+	//Seed; sort the codes first so the mapping is deterministic
+	statuses := make([]int, 0, len(f.fi.ForcedStatusRate))
+	for status := range f.fi.ForcedStatusRate {
+		statuses = append(statuses, status)
+	}
+	sort.Ints(statuses)
+
+	roll := f.rng.Float64()
+	var cumulative float64
+	for _, status := range statuses {
+		cumulative += f.fi.ForcedStatusRate[status]
+		if roll < cumulative {
+			return status, true
+		}
+	}
+	return 0, false
+}
+
+//truncatedBody limits how much of a response body callers can read while
+//still closing the underlying body correctly.
+type truncatedBody struct {
+	io.Reader
+	closer io.ReadCloser
+}
+
+func (t truncatedBody) Close() error {
+	return t.closer.Close()
+}
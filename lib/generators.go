@@ -0,0 +1,333 @@
+package pewpew
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	mathrand "math/rand"
+	"net/http"
+	"os"
+	"strings"
+	"text/template"
+	"time"
+
+	reggen "github.com/lucasjones/reggen"
+)
+
+//URLGenerator produces the next URL for a target. data, when non-nil,
+//is the current row from the target's DataFile and is made available to
+//template-based generators as the template root object.
+type URLGenerator interface {
+	NextURL(data interface{}) (string, error)
+}
+
+//BodyGenerator produces the next request body for a target, under the
+//same data contract as URLGenerator.
+type BodyGenerator interface {
+	NextBody(data interface{}) ([]byte, error)
+}
+
+//templateFuncs are available inside URL, body, and header templates:
+//{{uuid}}, {{randInt 1 100}}, and {{now}}. Headers are only rendered as a
+//template when the target has a DataFile.
+var templateFuncs = template.FuncMap{
+	"uuid": func() string {
+		return newUUID()
+	},
+	"randInt": func(min, max int) int {
+		return min + mathrand.Intn(max-min+1)
+	},
+	"now": func() string {
+		return time.Now().Format(time.RFC3339)
+	},
+}
+
+//newUUID generates a random (v4-ish) UUID string for the {{uuid}}
+//template function.
+func newUUID() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	b[6] = (b[6] & 0x0f) | 0x40
+	b[8] = (b[8] & 0x3f) | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:16])
+}
+
+//executeTemplateString renders text as a text/template with templateFuncs
+//available, using data as the root object.
+func executeTemplateString(text string, data interface{}) (string, error) {
+	tmpl, err := template.New("pewpew").Funcs(templateFuncs).Parse(text)
+	if err != nil {
+		return "", err
+	}
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, data); err != nil {
+		return "", err
+	}
+	return buf.String(), nil
+}
+
+//regexURLGenerator generates URLs by expanding a regex pattern, the
+//original RegexURL behavior. It ignores data, since reggen has no notion
+//of per-request substitution.
+type regexURLGenerator struct {
+	pattern string
+}
+
+func (g regexURLGenerator) NextURL(data interface{}) (string, error) {
+	urlStr, err := reggen.Generate(g.pattern, 10)
+	if err != nil {
+		return "", errors.New("failed to parse regex: " + err.Error())
+	}
+	return urlStr, nil
+}
+
+//templateURLGenerator renders a target's URL as a text/template on every
+//call. A plain URL with no template directives renders to itself
+//unchanged, so this also covers the common static-URL case.
+type templateURLGenerator struct {
+	tmpl *template.Template
+}
+
+func newTemplateURLGenerator(text string) (*templateURLGenerator, error) {
+	tmpl, err := template.New("url").Funcs(templateFuncs).Parse(text)
+	if err != nil {
+		return nil, errors.New("failed to parse URL template: " + err.Error())
+	}
+	return &templateURLGenerator{tmpl: tmpl}, nil
+}
+
+func (g *templateURLGenerator) NextURL(data interface{}) (string, error) {
+	var buf bytes.Buffer
+	if err := g.tmpl.Execute(&buf, data); err != nil {
+		return "", errors.New("failed to render URL template: " + err.Error())
+	}
+	return buf.String(), nil
+}
+
+//newURLGenerator picks the URLGenerator for a target's configuration.
+func newURLGenerator(t Target) (URLGenerator, error) {
+	if t.RegexURL {
+		return regexURLGenerator{pattern: t.URL}, nil
+	}
+	return newTemplateURLGenerator(t.URL)
+}
+
+//fileBodyGenerator returns the same body contents every call: the
+//contents of BodyFilename read once upfront, or no body when neither Body
+//nor BodyFilename is set. A literal Body goes to templateBodyGenerator.
+type fileBodyGenerator struct {
+	contents []byte
+}
+
+func (g fileBodyGenerator) NextBody(data interface{}) ([]byte, error) {
+	return g.contents, nil
+}
+
+//templateBodyGenerator renders a target's Body as a text/template on
+//every call.
+type templateBodyGenerator struct {
+	tmpl *template.Template
+}
+
+func newTemplateBodyGenerator(text string) (*templateBodyGenerator, error) {
+	tmpl, err := template.New("body").Funcs(templateFuncs).Parse(text)
+	if err != nil {
+		return nil, errors.New("failed to parse body template: " + err.Error())
+	}
+	return &templateBodyGenerator{tmpl: tmpl}, nil
+}
+
+func (g *templateBodyGenerator) NextBody(data interface{}) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := g.tmpl.Execute(&buf, data); err != nil {
+		return nil, errors.New("failed to render body template: " + err.Error())
+	}
+	return buf.Bytes(), nil
+}
+
+//newBodyGenerator picks the BodyGenerator for a target's configuration.
+func newBodyGenerator(t Target) (BodyGenerator, error) {
+	if t.BodyFilename != "" {
+		contents, err := ioutil.ReadFile(t.BodyFilename)
+		if err != nil {
+			return nil, errors.New("failed to read contents of file " + t.BodyFilename + ": " + err.Error())
+		}
+		return fileBodyGenerator{contents: contents}, nil
+	}
+	if t.Body == "" {
+		return fileBodyGenerator{contents: nil}, nil
+	}
+	return newTemplateBodyGenerator(t.Body)
+}
+
+//dataRowSource yields successive rows of per-request substitution data,
+//read from a target's DataFile. Rows cycle once exhausted, so Count (or
+//Duration) - not the file's length - controls how many requests a run
+//makes.
+type dataRowSource interface {
+	NextRow() (map[string]interface{}, error)
+}
+
+type csvRowSource struct {
+	headers []string
+	rows    [][]string
+	idx     int
+}
+
+func newCSVRowSource(filename string) (*csvRowSource, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	records, err := csv.NewReader(file).ReadAll()
+	if err != nil {
+		return nil, err
+	}
+	if len(records) < 2 {
+		return nil, fmt.Errorf("%s needs a header row plus at least one data row", filename)
+	}
+	return &csvRowSource{headers: records[0], rows: records[1:]}, nil
+}
+
+func (s *csvRowSource) NextRow() (map[string]interface{}, error) {
+	row := s.rows[s.idx%len(s.rows)]
+	s.idx++
+	m := make(map[string]interface{}, len(s.headers))
+	for i, header := range s.headers {
+		if i < len(row) {
+			m[header] = row[i]
+		}
+	}
+	return m, nil
+}
+
+type jsonlRowSource struct {
+	rows []map[string]interface{}
+	idx  int
+}
+
+func newJSONLRowSource(filename string) (*jsonlRowSource, error) {
+	contents, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	var rows []map[string]interface{}
+	for _, line := range strings.Split(strings.TrimSpace(string(contents)), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+		var row map[string]interface{}
+		if err := json.Unmarshal([]byte(line), &row); err != nil {
+			return nil, fmt.Errorf("failed to parse %s: %s", filename, err.Error())
+		}
+		rows = append(rows, row)
+	}
+	if len(rows) == 0 {
+		return nil, fmt.Errorf("%s has no data rows", filename)
+	}
+	return &jsonlRowSource{rows: rows}, nil
+}
+
+func (s *jsonlRowSource) NextRow() (map[string]interface{}, error) {
+	row := s.rows[s.idx%len(s.rows)]
+	s.idx++
+	return row, nil
+}
+
+//newDataRowSource returns nil, nil when the target has no DataFile
+//configured.
+func newDataRowSource(t Target) (dataRowSource, error) {
+	if t.DataFile == "" {
+		return nil, nil
+	}
+	format := t.DataFileFormat
+	if format == "" {
+		if strings.HasSuffix(t.DataFile, ".jsonl") || strings.HasSuffix(t.DataFile, ".ndjson") {
+			format = "jsonl"
+		} else {
+			format = "csv"
+		}
+	}
+	switch format {
+	case "csv":
+		return newCSVRowSource(t.DataFile)
+	case "jsonl":
+		return newJSONLRowSource(t.DataFile)
+	default:
+		return nil, fmt.Errorf("unknown data file format: %s", format)
+	}
+}
+
+//requestSource lazily produces requests for a single target, pulling
+//from a data file row-by-row when one is configured, until Count
+//requests have been generated or Duration has elapsed.
+type requestSource struct {
+	target  Target
+	urlGen  URLGenerator
+	bodyGen BodyGenerator
+	data    dataRowSource
+
+	remaining int       //requests left to generate; negative means unbounded (Duration governs instead)
+	deadline  time.Time //zero value means no deadline
+}
+
+func newRequestSource(t Target) (*requestSource, error) {
+	urlGen, err := newURLGenerator(t)
+	if err != nil {
+		return nil, err
+	}
+	bodyGen, err := newBodyGenerator(t)
+	if err != nil {
+		return nil, err
+	}
+	data, err := newDataRowSource(t)
+	if err != nil {
+		return nil, err
+	}
+
+	rs := &requestSource{target: t, urlGen: urlGen, bodyGen: bodyGen, data: data}
+	if t.Duration != "" {
+		duration, _ := time.ParseDuration(t.Duration) //already validated
+		rs.deadline = time.Now().Add(duration)
+		rs.remaining = -1
+	} else {
+		rs.remaining = t.Count
+	}
+	return rs, nil
+}
+
+//Next produces the next request. done is true once the source is
+//exhausted, at which point req and err are both zero values.
+func (rs *requestSource) Next() (req http.Request, done bool, err error) {
+	if rs.remaining == 0 {
+		return http.Request{}, true, nil
+	}
+	if !rs.deadline.IsZero() && !time.Now().Before(rs.deadline) {
+		return http.Request{}, true, nil
+	}
+
+	var row interface{}
+	if rs.data != nil {
+		r, err := rs.data.NextRow()
+		if err != nil {
+			return http.Request{}, false, err
+		}
+		row = r
+	}
+
+	req, err = buildRequest(rs.target, rs.urlGen, rs.bodyGen, row)
+	if err != nil {
+		return http.Request{}, false, err
+	}
+
+	if rs.remaining > 0 {
+		rs.remaining--
+	}
+	return req, false, nil
+}
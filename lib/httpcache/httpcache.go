@@ -0,0 +1,80 @@
+//Package httpcache is a small, fixed-capacity, in-process LRU used by
+//pewpew's SharedCache target mode to serve repeat requests locally, so a
+//stress run can approximate load against a cache-fronted service instead
+//of always hitting the origin.
+package httpcache
+
+import (
+	"container/list"
+	"sync"
+)
+
+//Entry is a single cached response.
+type Entry struct {
+	StatusCode int
+	Header     map[string][]string
+	Body       []byte
+}
+
+//LRU is a fixed-capacity cache of Entries keyed by an arbitrary string,
+//typically a request URL. It's safe for concurrent use.
+type LRU struct {
+	mu       sync.Mutex
+	capacity int
+	ll       *list.List
+	items    map[string]*list.Element
+}
+
+type lruEntry struct {
+	key   string
+	value Entry
+}
+
+//DefaultCapacity is used when New is given a capacity <= 0.
+const DefaultCapacity = 1000
+
+//New creates an LRU holding up to capacity entries.
+func New(capacity int) *LRU {
+	if capacity <= 0 {
+		capacity = DefaultCapacity
+	}
+	return &LRU{
+		capacity: capacity,
+		ll:       list.New(),
+		items:    make(map[string]*list.Element),
+	}
+}
+
+//Get returns the cached entry for key, if present, moving it to the
+//front of the eviction order.
+func (c *LRU) Get(key string) (Entry, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	el, ok := c.items[key]
+	if !ok {
+		return Entry{}, false
+	}
+	c.ll.MoveToFront(el)
+	return el.Value.(*lruEntry).value, true
+}
+
+//Set stores value under key, evicting the least recently used entry if
+//the cache is over capacity.
+func (c *LRU) Set(key string, value Entry) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if el, ok := c.items[key]; ok {
+		el.Value.(*lruEntry).value = value
+		c.ll.MoveToFront(el)
+		return
+	}
+	el := c.ll.PushFront(&lruEntry{key: key, value: value})
+	c.items[key] = el
+	if c.ll.Len() > c.capacity {
+		oldest := c.ll.Back()
+		if oldest != nil {
+			c.ll.Remove(oldest)
+			delete(c.items, oldest.Value.(*lruEntry).key)
+		}
+	}
+}
@@ -0,0 +1,118 @@
+package pewpew
+
+import (
+	"math/rand"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+//defaultBackoffInitial is used when a Retry is enabled but doesn't set
+//BackoffInitial.
+const defaultBackoffInitial = 100 * time.Millisecond
+
+//requestIDCounter hands out ParentIDs so every attempt at the same
+//logical request can be correlated in the output.
+var requestIDCounter int64
+
+func nextRequestID() int64 {
+	return atomic.AddInt64(&requestIDCounter, 1)
+}
+
+//Retry describes a per-target retry-with-backoff policy.
+type Retry struct {
+	//MaxAttempts is the total number of tries, including the first.
+	//1 or 0 means no retries.
+	MaxAttempts int
+	//BackoffInitial is the delay before the first retry. Defaults to
+	//100ms if unset.
+	BackoffInitial time.Duration
+	//BackoffMax caps the delay between retries. Zero means no cap.
+	BackoffMax time.Duration
+	//Multiplier grows the delay after each attempt, e.g. 2.0 doubles it.
+	//Zero or one means the delay doesn't grow.
+	Multiplier float64
+	//RetryOn lists HTTP status codes that should trigger a retry.
+	RetryOn []int
+	//RetryOnError retries when the request itself failed (connection
+	//refused, timeout, etc.) rather than returning a response.
+	RetryOnError bool
+}
+
+func (r Retry) enabled() bool {
+	return r.MaxAttempts > 1
+}
+
+func (r Retry) shouldRetry(stat requestStat) bool {
+	if stat.Error != nil {
+		return r.RetryOnError
+	}
+	for _, code := range r.RetryOn {
+		if stat.StatusCode == code {
+			return true
+		}
+	}
+	return false
+}
+
+//runRequestWithRetry runs req, retrying according to retry's policy.
+//It returns the last response seen and one requestStat per attempt, each
+//tagged with the same ParentID and its own Attempt number, so the
+//summary can report success-after-retry vs. hard-failure rates.
+func runRequestWithRetry(req http.Request, client *http.Client, retry Retry) (*http.Response, []requestStat) {
+	parentID := nextRequestID()
+	maxAttempts := retry.MaxAttempts
+	if maxAttempts < 1 {
+		maxAttempts = 1
+	}
+	backoff := retry.BackoffInitial
+	if backoff <= 0 {
+		backoff = defaultBackoffInitial
+	}
+
+	var response *http.Response
+	stats := make([]requestStat, 0, maxAttempts)
+	for attempt := 1; attempt <= maxAttempts; attempt++ {
+		if attempt > 1 && req.GetBody != nil {
+			//req.Body was already drained by the previous attempt; rewind it
+			//so a retried POST/PUT resends its body instead of an empty one
+			body, err := req.GetBody()
+			if err == nil {
+				req.Body = body
+			}
+		}
+		resp, stat := runRequest(req, client)
+		stat.ParentID = parentID
+		stat.Attempt = attempt
+		if resp != nil {
+			stat.CacheStatus, stat.CacheBytesSaved = cacheStatusFromResponse(resp)
+		}
+		stats = append(stats, stat)
+		response = resp
+
+		if attempt == maxAttempts || !retry.shouldRetry(stat) {
+			break
+		}
+
+		//jitter: sleep somewhere between half and one and a half of the
+		//nominal backoff (never more than BackoffMax), so retries from many
+		//workers don't land in lockstep
+		sleep := backoff/2 + time.Duration(rand.Int63n(int64(backoff)))
+		if retry.BackoffMax > 0 && sleep > retry.BackoffMax {
+			sleep = retry.BackoffMax
+		}
+		select {
+		case <-req.Context().Done():
+			return response, stats
+		case <-time.After(sleep):
+		}
+
+		if retry.Multiplier > 0 {
+			backoff = time.Duration(float64(backoff) * retry.Multiplier)
+		}
+		if retry.BackoffMax > 0 && backoff > retry.BackoffMax {
+			backoff = retry.BackoffMax
+		}
+	}
+	return response, stats
+}
@@ -0,0 +1,231 @@
+package pewpew
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"os"
+)
+
+//StatSink receives each requestStat as it's produced, instead of the
+//caller buffering every result in memory for the duration of the run.
+//The implementations in this package do no locking of their own; callers
+//that write from several goroutines serialize their calls (RunStress
+//holds sinkLock).
+type StatSink interface {
+	Write(stat requestStat) error
+	Close() error
+}
+
+//multiSink fans a single stat out to several sinks, so a run can write
+//NDJSON to disk and feed a summary reservoir at the same time.
+type multiSink struct {
+	sinks []StatSink
+}
+
+func newMultiSink(sinks ...StatSink) *multiSink {
+	return &multiSink{sinks: sinks}
+}
+
+func (m *multiSink) Write(stat requestStat) error {
+	for _, sink := range m.sinks {
+		if err := sink.Write(stat); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (m *multiSink) Close() error {
+	for _, sink := range m.sinks {
+		if err := sink.Close(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+//ndjsonSink appends one JSON object per line as stats arrive, so a run
+//of millions of requests doesn't have to hold them all in RAM for a
+//final json.MarshalIndent.
+type ndjsonSink struct {
+	file    *os.File
+	encoder *json.Encoder
+}
+
+//NewNDJSONSink creates filename (truncating it if it exists) and returns
+//a StatSink that appends one JSON-encoded requestStat per line.
+func NewNDJSONSink(filename string) (StatSink, error) {
+	file, err := os.Create(filename)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create %s: %s", filename, err.Error())
+	}
+	return &ndjsonSink{file: file, encoder: json.NewEncoder(file)}, nil
+}
+
+func (n *ndjsonSink) Write(stat requestStat) error {
+	return n.encoder.Encode(stat)
+}
+
+func (n *ndjsonSink) Close() error {
+	return n.file.Close()
+}
+
+//csvSink appends one row per stat as they arrive.
+type csvSink struct {
+	file   *os.File
+	writer *csv.Writer
+}
+
+//NewCSVSink creates filename (truncating it if it exists), writes a header row, and
+//returns a StatSink that appends one row per requestStat.
+func NewCSVSink(filename string) (StatSink, error) {
+	file, err := os.Create(filename)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create %s: %s", filename, err.Error())
+	}
+	writer := csv.NewWriter(file)
+	err = writer.Write([]string{"startTime", "duration", "statusCode", "bytes"})
+	if err != nil {
+		file.Close()
+		return nil, fmt.Errorf("failed to write header to %s: %s", filename, err.Error())
+	}
+	writer.Flush()
+	return &csvSink{file: file, writer: writer}, nil
+}
+
+func (c *csvSink) Write(stat requestStat) error {
+	err := c.writer.Write([]string{
+		stat.StartTime.String(),
+		fmt.Sprintf("%d", stat.Duration),
+		fmt.Sprintf("%d", stat.StatusCode),
+		fmt.Sprintf("%d bytes", stat.DataTransferred),
+	})
+	c.writer.Flush()
+	return err
+}
+
+func (c *csvSink) Close() error {
+	c.writer.Flush()
+	return c.file.Close()
+}
+
+//reservoirCap bounds how many raw stats a ringBufferSink keeps around for
+//percentile estimation, so memory stays flat no matter how long a run goes.
+const reservoirCap = 10000
+
+//ringBufferSink keeps a bounded, reservoir-sampled window of stats in
+//memory so createRequestsStats/createTextSummary can estimate percentiles
+//without requiring every stat a run has ever produced. Counts, byte
+//totals, and status code tallies are tracked exactly; only the
+//percentile estimate is approximate.
+type ringBufferSink struct {
+	sample []requestStat //reservoir sample, capped at reservoirCap
+	seen   int           //total stats seen, including ones not kept in sample
+
+	count           int
+	errorCount      int
+	totalDuration   int64 //nanoseconds
+	dataTransferred int64
+	statusCodes     map[int]int
+	cacheStatuses   map[string]int //"hit", "miss", "revalidated" -> exact count
+	bytesSaved      int64          //body bytes not re-fetched over the wire on a hit/revalidated response
+}
+
+//exactStats is the set of totals ringBufferSink tracks on every Write,
+//independent of the reservoir sample, so a summary can report them
+//without the sampling error a percentile estimate tolerates.
+type exactStats struct {
+	Count           int
+	ErrorCount      int
+	TotalDuration   int64
+	DataTransferred int64
+	StatusCodes     map[int]int
+	CacheStatuses   map[string]int
+	BytesSaved      int64
+}
+
+//NewRingBufferSink creates a StatSink that tracks exact totals and a
+//reservoir sample for percentile estimation, bounding memory regardless
+//of how many requests the run produces.
+func NewRingBufferSink() *ringBufferSink {
+	return &ringBufferSink{
+		sample:        make([]requestStat, 0, reservoirCap),
+		statusCodes:   make(map[int]int),
+		cacheStatuses: make(map[string]int),
+	}
+}
+
+func (r *ringBufferSink) Write(stat requestStat) error {
+	r.seen++
+	r.count++
+	r.totalDuration += int64(stat.Duration)
+	r.dataTransferred += int64(stat.DataTransferred)
+	r.statusCodes[stat.StatusCode]++
+	if stat.Error != nil {
+		r.errorCount++
+	}
+	if stat.CacheStatus != "" {
+		r.cacheStatuses[stat.CacheStatus]++
+		switch stat.CacheStatus {
+		case "hit":
+			//the whole body was served locally instead of over the network
+			r.bytesSaved += int64(stat.DataTransferred)
+		case "revalidated":
+			//the 304 itself has no body; what was saved is the previously
+			//cached response's body, which CacheBytesSaved carries since
+			//DataTransferred only reflects this request's near-empty reply
+			if stat.CacheBytesSaved > 0 {
+				r.bytesSaved += stat.CacheBytesSaved
+			}
+		}
+	}
+
+	if len(r.sample) < reservoirCap {
+		r.sample = append(r.sample, stat)
+		return nil
+	}
+	//reservoir sampling: replace a random existing entry with
+	//decreasing probability as more stats are seen
+	if j := rand.Intn(r.seen); j < reservoirCap {
+		r.sample[j] = stat
+	}
+	return nil
+}
+
+func (r *ringBufferSink) Close() error {
+	return nil
+}
+
+//Stats returns the reservoir sample collected so far. createRequestsStats
+//can run its existing percentile/summary logic over this sample; it's
+//representative of the full run, not exhaustive.
+func (r *ringBufferSink) Stats() []requestStat {
+	return r.sample
+}
+
+//ExactStats returns the totals tracked on every Write, not just the
+//reservoir sample. A summary should report request count, byte totals,
+//throughput, and status/cache tallies from here instead of the sample,
+//which is capped at reservoirCap and understates them on any run over
+//that size; the sample is only a good source for percentile estimates.
+func (r *ringBufferSink) ExactStats() exactStats {
+	statusCodes := make(map[int]int, len(r.statusCodes))
+	for code, n := range r.statusCodes {
+		statusCodes[code] = n
+	}
+	cacheStatuses := make(map[string]int, len(r.cacheStatuses))
+	for status, n := range r.cacheStatuses {
+		cacheStatuses[status] = n
+	}
+	return exactStats{
+		Count:           r.count,
+		ErrorCount:      r.errorCount,
+		TotalDuration:   r.totalDuration,
+		DataTransferred: r.dataTransferred,
+		StatusCodes:     statusCodes,
+		CacheStatuses:   cacheStatuses,
+		BytesSaved:      r.bytesSaved,
+	}
+}
@@ -2,26 +2,31 @@ package pewpew
 
 import (
 	"bytes"
+	"context"
 	"crypto/tls"
-	"encoding/csv"
-	"encoding/json"
 	"errors"
 	"fmt"
-	"io/ioutil"
+	"net"
 	"net/http"
 	"net/url"
-	"os"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
-	reggen "github.com/lucasjones/reggen"
 	http2 "golang.org/x/net/http2"
+	"golang.org/x/time/rate"
 )
 
 //so concurrent workers don't interlace messages
 var writeLock sync.Mutex
 
+//ErrRestart is returned by RunStress when the run was stopped via the
+//control endpoint's /restart route. Callers that want restart support
+//should loop on RunStress and treat this error as "run again" rather
+//than a failure.
+var ErrRestart = errors.New("stress test restarted")
+
 type workerDone struct{}
 
 type requestStat struct {
@@ -36,6 +41,22 @@ type requestStat struct {
 	StatusCode      int   `json:"statusCode"`
 	Error           error `json:"error"`
 	DataTransferred int   //bytes
+
+	//ParentID groups every attempt at the same logical request together;
+	//all attempts share the value generated for the first one.
+	ParentID int64 `json:"parentId"`
+	//Attempt is 1 for the first try, 2 for the first retry, and so on.
+	Attempt int `json:"attempt"`
+
+	//CacheStatus is "hit", "miss", or "revalidated" when UseConditional
+	//or SharedCache is enabled on the target, empty otherwise.
+	CacheStatus string `json:"cacheStatus,omitempty"`
+	//CacheBytesSaved is the body size a "revalidated" response saved by
+	//not being re-downloaded; -1 if the origin's Content-Length wasn't
+	//known on the response that was revalidated against, and -1 on every
+	//response that wasn't revalidated. Unused for "hit"/"miss", where
+	//DataTransferred already reflects the savings.
+	CacheBytesSaved int64 `json:"cacheBytesSaved,omitempty"`
 }
 
 type (
@@ -46,6 +67,9 @@ type (
 		Quiet              bool
 		NoHTTP2            bool
 		EnforceSSL         bool
+		//ResultFilenameJSON, if set, is streamed newline-delimited JSON,
+		//one requestStat per line, written as requests complete rather
+		//than buffered and marshalled at the end of the run.
 		ResultFilenameJSON string
 		ResultFilenameCSV  string
 
@@ -62,6 +86,20 @@ type (
 		BasicAuth    string
 		Compress     bool
 		KeepAlive    bool
+
+		//GlobalRPS caps the combined send rate across all targets, in
+		//requests per second. Zero means no global cap; each target is
+		//still bounded by its own RPS/Burst.
+		GlobalRPS int
+		//GlobalBurst is the token bucket burst size for GlobalRPS.
+		//Defaults to GlobalRPS if unset.
+		GlobalBurst int
+
+		//ControlAddr, if set, serves an HTTP control endpoint on this
+		//address (e.g. "localhost:9900") exposing the POST routes
+		//"/stop", "/pause", "/resume", and "/restart" so an operator can steer a long-running
+		//test without killing the process.
+		ControlAddr string
 	}
 	Target struct {
 		URL          string
@@ -77,6 +115,49 @@ type (
 		BasicAuth    string
 		Compress     bool
 		KeepAlive    bool
+
+		//RPS caps this target's send rate, in requests per second.
+		//Zero means unlimited.
+		RPS int
+		//Burst is the token bucket burst size for RPS. Defaults to RPS if unset.
+		Burst int
+		//Duration, if set, runs the target for this long instead of for
+		//a fixed Count, generating requests on-the-fly as the queue drains.
+		//Parsed with time.ParseDuration, e.g. "30s".
+		Duration string
+
+		//FaultInjection, if enabled, wraps this target's transport with
+		//synthetic drops, latency, forced statuses, and body truncation.
+		FaultInjection FaultInjection
+
+		//Retry, if its MaxAttempts is above 1, retries failed requests
+		//with backoff according to its policy.
+		Retry Retry
+
+		//DataFile, if set, is a CSV or JSON-lines file of per-request
+		//data. Each request pulls the next row (cycling once exhausted)
+		//and makes it available to the URL, Headers, and Body templates.
+		DataFile string
+		//DataFileFormat is "csv" or "jsonl". Inferred from DataFile's
+		//extension if unset.
+		DataFileFormat string
+
+		//UseConditional validates repeat requests to the same URL with
+		//If-None-Match/If-Modified-Since, captured from that URL's first
+		//response, and records how often the origin answers 304 vs 200.
+		UseConditional bool
+		//CacheValidation restricts UseConditional to "etag" or
+		//"last-modified" only. Empty uses whichever validators the origin
+		//provided.
+		CacheValidation string
+
+		//SharedCache serves repeat requests to the same URL from a small
+		//in-process LRU instead of the network, so only cache misses
+		//count as real requests against the target.
+		SharedCache bool
+		//CacheCapacity sizes the SharedCache LRU. Defaults to
+		//httpcache.DefaultCapacity if unset.
+		CacheCapacity int
 	}
 )
 
@@ -109,8 +190,12 @@ func NewStressConfig() (s *StressConfig) {
 	return
 }
 
-//RunStress starts the stress tests
-func RunStress(s StressConfig) error {
+//RunStress starts the stress tests. It stops cleanly, flushing whatever
+//results have streamed out so far, when ctx is cancelled - callers that
+//want Ctrl-C to stop the test should derive ctx from
+//signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+//and pass it in here.
+func RunStress(ctx context.Context, s StressConfig) error {
 	err := ValidateTargets(s)
 	if err != nil {
 		fmt.Println(err.Error())
@@ -118,19 +203,95 @@ func RunStress(s StressConfig) error {
 	}
 	targetCount := len(s.Targets)
 
-	//setup the queue of requests, one queue per target
+	runCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	//wall-clock span of the run, used to report throughput in the summary
+	runStart := time.Now()
+
+	var restarted int32 //set to 1 if /restart was hit, read after the run stops
+	var paused int32     //1 while paused via the control endpoint
+
+	if s.ControlAddr != "" {
+		listener, err := net.Listen("tcp", s.ControlAddr)
+		if err != nil {
+			return errors.New("failed to start control endpoint: " + err.Error())
+		}
+		controlServer := newControlServer(cancel, &restarted, &paused)
+		go controlServer.Serve(listener)
+		defer controlServer.Shutdown(context.Background())
+	}
+
+	//stats stream out to these sinks as they arrive, instead of being
+	//buffered in memory for the duration of the run
+	var fileSinks []StatSink
+	if s.ResultFilenameJSON != "" {
+		sink, err := NewNDJSONSink(s.ResultFilenameJSON)
+		if err != nil {
+			return err
+		}
+		fileSinks = append(fileSinks, sink)
+	}
+	if s.ResultFilenameCSV != "" {
+		sink, err := NewCSVSink(s.ResultFilenameCSV)
+		if err != nil {
+			return err
+		}
+		fileSinks = append(fileSinks, sink)
+	}
+	fileSink := newMultiSink(fileSinks...)
+	var sinkLock sync.Mutex
+	globalRing := NewRingBufferSink()
+
+	//global limiter, shared across all targets, if configured
+	var globalLimiter *rate.Limiter
+	if s.GlobalRPS > 0 {
+		burst := s.GlobalBurst
+		if burst <= 0 {
+			burst = s.GlobalRPS
+		}
+		globalLimiter = rate.NewLimiter(rate.Limit(s.GlobalRPS), burst)
+	}
+
+	//setup the queue of requests, one queue per target. Requests are
+	//produced lazily by each target's requestSource rather than
+	//pre-built, so a Count in the millions (or an open-ended Duration)
+	//doesn't require pre-allocating every http.Request up front.
 	requestQueues := make([](chan http.Request), targetCount)
 	for idx, target := range s.Targets {
-		requestQueues[idx] = make(chan http.Request, target.Count)
-		for i := 0; i < target.Count; i++ {
-			req, err := buildRequest(target)
-			if err != nil {
-				fmt.Println(err.Error())
-				return errors.New("failed to create request with target configuration")
-			}
-			requestQueues[idx] <- req
+		source, err := newRequestSource(target)
+		if err != nil {
+			fmt.Println(err.Error())
+			return errors.New("failed to create request generator for target configuration")
+		}
+		queueSize := target.Concurrency
+		if queueSize < 1 {
+			queueSize = 1
 		}
-		close(requestQueues[idx])
+		requestQueues[idx] = make(chan http.Request, queueSize)
+		go func(source *requestSource, requestQueue chan http.Request) {
+			defer close(requestQueue)
+			for {
+				select {
+				case <-runCtx.Done():
+					return
+				default:
+				}
+				req, done, err := source.Next()
+				if err != nil {
+					fmt.Println(err.Error())
+					return
+				}
+				if done {
+					return
+				}
+				select {
+				case requestQueue <- req:
+				case <-runCtx.Done():
+					return
+				}
+			}
+		}(source, requestQueues[idx])
 	}
 
 	if targetCount == 1 {
@@ -140,10 +301,24 @@ func RunStress(s StressConfig) error {
 	}
 
 	//when a target is finished, send all stats into this
-	targetStats := make(chan []requestStat)
+	targetStats := make(chan *ringBufferSink)
 	for idx, target := range s.Targets {
-		go func(target Target, requestQueue chan http.Request, targetStats chan []requestStat) {
-			fmt.Printf("- Running %d tests at %s, %d at a time\n", target.Count, target.URL, target.Concurrency)
+		go func(target Target, requestQueue chan http.Request, targetStats chan *ringBufferSink) {
+			if target.Duration != "" {
+				fmt.Printf("- Running tests at %s for %s, %d at a time\n", target.URL, target.Duration, target.Concurrency)
+			} else {
+				fmt.Printf("- Running %d tests at %s, %d at a time\n", target.Count, target.URL, target.Concurrency)
+			}
+
+			//per-target rate limiter, if configured
+			var limiter *rate.Limiter
+			if target.RPS > 0 {
+				burst := target.Burst
+				if burst <= 0 {
+					burst = target.RPS
+				}
+				limiter = rate.NewLimiter(rate.Limit(target.RPS), burst)
+			}
 
 			workerDoneChan := make(chan workerDone)   //workers use this to indicate they are done
 			requestStatChan := make(chan requestStat) //workers communicate each requests' info
@@ -163,13 +338,36 @@ func RunStress(s StressConfig) error {
 			} else {
 				timeout = time.Duration(0)
 			}
-			client := &http.Client{Timeout: timeout, Transport: tr}
+			var transport http.RoundTripper = tr
+			if cachingEnabled(target) {
+				transport = newCachingRoundTripper(transport, target)
+			}
+			if target.FaultInjection.enabled() {
+				transport = newFaultRoundTripper(transport, target.FaultInjection)
+			}
+			client := &http.Client{Timeout: timeout, Transport: transport}
 
 			//start up the workers
 			for i := 0; i < target.Concurrency; i++ {
 				go func() {
 					for {
+						//block here (without consuming a request) while paused,
+						//so a /resume picks back up exactly where it left off
+						for atomic.LoadInt32(&paused) == 1 {
+							select {
+							case <-runCtx.Done():
+								workerDoneChan <- workerDone{}
+								return
+							case <-time.After(100 * time.Millisecond):
+							}
+						}
+
 						select {
+						case <-runCtx.Done():
+							//stop accepting new work; whatever already streamed to
+							//the sinks stays, per ctx cancellation stopping cleanly
+							workerDoneChan <- workerDone{}
+							return
 						case req, ok := <-requestQueue:
 							if !ok {
 								//queue is empty
@@ -177,23 +375,57 @@ func RunStress(s StressConfig) error {
 								return
 							}
 
-							response, stat := runRequest(req, client)
+							//pace the send rate according to the target and global limiters, if configured;
+							//Wait returns an error (instead of blocking) once runCtx is cancelled, so bail
+							//out rather than dispatching a request the run is trying to stop
+							if limiter != nil {
+								if err := limiter.Wait(runCtx); err != nil {
+									workerDoneChan <- workerDone{}
+									return
+								}
+							}
+							if globalLimiter != nil {
+								if err := globalLimiter.Wait(runCtx); err != nil {
+									workerDoneChan <- workerDone{}
+									return
+								}
+							}
+
+							req = *req.WithContext(runCtx)
+
+							var response *http.Response
+							var stats []requestStat
+							if target.Retry.enabled() {
+								response, stats = runRequestWithRetry(req, client, target.Retry)
+							} else {
+								resp, stat := runRequest(req, client)
+								stat.ParentID = nextRequestID()
+								stat.Attempt = 1
+								if resp != nil {
+									stat.CacheStatus, stat.CacheBytesSaved = cacheStatusFromResponse(resp)
+								}
+								response, stats = resp, []requestStat{stat}
+							}
+
 							if !s.Quiet {
 								writeLock.Lock()
-								printStat(stat)
+								for _, stat := range stats {
+									printStat(stat)
+								}
 								if s.Verbose {
 									printVerbose(&req, response)
 								}
 								writeLock.Unlock()
 							}
 
-							requestStatChan <- stat
+							for _, stat := range stats {
+								requestStatChan <- stat
+							}
 						}
 					}
 				}()
 			}
-			requestStats := make([]requestStat, target.Count)
-			requestsCompleteCount := 0
+			targetRing := NewRingBufferSink()
 			workersDoneCount := 0
 			//wait for all workers to finish
 			for {
@@ -201,23 +433,30 @@ func RunStress(s StressConfig) error {
 				case <-workerDoneChan:
 					workersDoneCount++
 				case stat := <-requestStatChan:
-					requestStats[requestsCompleteCount] = stat
-					requestsCompleteCount++
+					//write the stat out immediately instead of buffering it for
+					//the duration of the run; only a bounded sample is kept in
+					//memory for percentile estimation
+					targetRing.Write(stat)
+
+					sinkLock.Lock()
+					globalRing.Write(stat)
+					fileSink.Write(stat)
+					sinkLock.Unlock()
 				}
 				if workersDoneCount == target.Concurrency {
 					//all workers are finished
 					break
 				}
 			}
-			targetStats <- requestStats
+			targetStats <- targetRing
 		}(target, requestQueues[idx], targetStats)
 	}
-	targetRequestStats := make([][]requestStat, targetCount)
+	targetRings := make([]*ringBufferSink, targetCount)
 	targetDoneCount := 0
 	for {
 		select {
-		case reqStats := <-targetStats:
-			targetRequestStats[targetDoneCount] = reqStats
+		case ring := <-targetStats:
+			targetRings[targetDoneCount] = ring
 			targetDoneCount++
 		}
 		if targetDoneCount == targetCount {
@@ -226,6 +465,12 @@ func RunStress(s StressConfig) error {
 		}
 	}
 
+	if err := fileSink.Close(); err != nil {
+		return errors.New("failed to write full result data: " + err.Error())
+	}
+
+	elapsed := time.Since(runStart)
+
 	fmt.Print("\n----Summary----\n\n")
 
 	//only print individual target data if multiple targets
@@ -233,62 +478,19 @@ func RunStress(s StressConfig) error {
 		for idx, target := range s.Targets {
 			//info about the request
 			fmt.Printf("----Target %d: %s %s\n", idx+1, target.Method, target.URL)
-			reqStats := createRequestsStats(targetRequestStats[idx])
-			fmt.Println(createTextSummary(reqStats))
+			reqStats := createRequestsStats(targetRings[idx].Stats())
+			fmt.Println(createTextSummary(reqStats, targetRings[idx].ExactStats(), elapsed))
 		}
 	}
 
-	//combine individual targets to a total one
-	globalStats := []requestStat{}
-	for i := range s.Targets {
-		for j := range targetRequestStats[i] {
-			globalStats = append(globalStats, targetRequestStats[i][j])
-		}
-	}
 	if len(s.Targets) > 1 {
 		fmt.Println("----Global----")
 	}
-	reqStats := createRequestsStats(globalStats)
-	fmt.Println(createTextSummary(reqStats))
-
-	//write out json
-	if s.ResultFilenameJSON != "" {
-		fmt.Print("Writing full result data to: " + s.ResultFilenameJSON + " ...")
-		json, _ := json.MarshalIndent(globalStats, "", "    ")
-		err = ioutil.WriteFile(s.ResultFilenameJSON, json, 0644)
-		if err != nil {
-			return errors.New("failed to write full result data to " +
-				s.ResultFilenameJSON + ": " + err.Error())
-		}
-		fmt.Println("finished!")
-	}
-	//write out csv
-	if s.ResultFilenameCSV != "" {
-		fmt.Print("Writing full result data to: " + s.ResultFilenameCSV + " ...")
-		file, err := os.Create(s.ResultFilenameCSV)
-		if err != nil {
-			return errors.New("failed to write full result data to " +
-				s.ResultFilenameCSV + ": " + err.Error())
-		}
-		defer file.Close()
+	reqStats := createRequestsStats(globalRing.Stats())
+	fmt.Println(createTextSummary(reqStats, globalRing.ExactStats(), elapsed))
 
-		writer := csv.NewWriter(file)
-
-		for _, req := range globalStats {
-			line := []string{
-				req.StartTime.String(),
-				fmt.Sprintf("%d", req.Duration),
-				fmt.Sprintf("%d", req.StatusCode),
-				fmt.Sprintf("%d bytes", req.DataTransferred),
-			}
-			err := writer.Write(line)
-			if err != nil {
-				return errors.New("failed to write full result data to " +
-					s.ResultFilenameCSV + ": " + err.Error())
-			}
-		}
-		defer writer.Flush()
-		fmt.Println("finished!")
+	if atomic.LoadInt32(&restarted) == 1 {
+		return ErrRestart
 	}
 	return nil
 }
@@ -302,12 +504,27 @@ func ValidateTargets(s StressConfig) error {
 		if target.URL == "" {
 			return errors.New("empty URL")
 		}
-		if target.Count <= 0 {
+		if target.Duration != "" {
+			duration, err := time.ParseDuration(target.Duration)
+			if err != nil {
+				fmt.Println(err)
+				return errors.New("failed to parse duration: " + target.Duration)
+			}
+			if duration <= 0 {
+				return errors.New("duration must be greater than zero")
+			}
+		} else if target.Count <= 0 {
 			return errors.New("request count must be greater than zero")
 		}
 		if target.Concurrency <= 0 {
 			return errors.New("concurrency must be greater than zero")
 		}
+		if target.RPS < 0 {
+			return errors.New("RPS must not be negative")
+		}
+		if target.Retry.MaxAttempts < 0 {
+			return errors.New("retry max attempts must not be negative")
+		}
 		if target.Timeout != "" {
 			//TODO should save this parsed duration so don't have to inefficiently reparse later
 			timeout, err := time.ParseDuration(target.Timeout)
@@ -319,25 +536,21 @@ func ValidateTargets(s StressConfig) error {
 				return errors.New("timeout must be greater than one millisecond")
 			}
 		}
-		if target.Concurrency > target.Count {
+		if target.Duration == "" && target.Concurrency > target.Count {
 			return errors.New("concurrency must be higher than request count")
 		}
 	}
 	return nil
 }
 
-//build the http request out of the target's config
-func buildRequest(t Target) (http.Request, error) {
-	var urlStr string
-	var err error
-	//when regex set, generate urls
-	if t.RegexURL {
-		urlStr, err = reggen.Generate(t.URL, 10)
-		if err != nil {
-			return http.Request{}, errors.New("failed to parse regex: " + err.Error())
-		}
-	} else {
-		urlStr = t.URL
+//build the http request out of the target's config, using urlGen and
+//bodyGen to produce this request's URL and body. data is the current row
+//from the target's DataFile, or nil if it has none; it's also threaded
+//through to the Headers template.
+func buildRequest(t Target, urlGen URLGenerator, bodyGen BodyGenerator, data interface{}) (http.Request, error) {
+	urlStr, err := urlGen.NextURL(data)
+	if err != nil {
+		return http.Request{}, err
 	}
 	URL, err := url.Parse(urlStr)
 	if err != nil {
@@ -348,16 +561,15 @@ func buildRequest(t Target) (http.Request, error) {
 		URL.Scheme = "http"
 	}
 
+	bodyBytes, err := bodyGen.NextBody(data)
+	if err != nil {
+		return http.Request{}, err
+	}
+
 	//setup the request
 	var req *http.Request
-	if t.BodyFilename != "" {
-		fileContents, err := ioutil.ReadFile(t.BodyFilename)
-		if err != nil {
-			return http.Request{}, errors.New("failed to read contents of file " + t.BodyFilename + ": " + err.Error())
-		}
-		req, err = http.NewRequest(t.Method, URL.String(), bytes.NewBuffer(fileContents))
-	} else if t.Body != "" {
-		req, err = http.NewRequest(t.Method, URL.String(), bytes.NewBuffer([]byte(t.Body)))
+	if len(bodyBytes) > 0 {
+		req, err = http.NewRequest(t.Method, URL.String(), bytes.NewBuffer(bodyBytes))
 	} else {
 		req, err = http.NewRequest(t.Method, URL.String(), nil)
 	}
@@ -366,7 +578,14 @@ func buildRequest(t Target) (http.Request, error) {
 	}
 	//add headers
 	if t.Headers != "" {
-		headerMap, err := parseKeyValString(t.Headers, ",", ":")
+		headersStr := t.Headers
+		if data != nil {
+			headersStr, err = executeTemplateString(t.Headers, data)
+			if err != nil {
+				return http.Request{}, errors.New("failed to render headers template: " + err.Error())
+			}
+		}
+		headerMap, err := parseKeyValString(headersStr, ",", ":")
 		if err != nil {
 			fmt.Println(err)
 			return http.Request{}, errors.New("could not parse headers")
@@ -0,0 +1,104 @@
+package pewpew
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+//requestsStats holds the latency distribution for a run or a single
+//target, estimated from ringBufferSink's reservoir sample. Request
+//count, byte totals, and status/cache tallies are NOT computed here —
+//those come from exactStats, which is tracked exactly regardless of how
+//large the sample is.
+type requestsStats struct {
+	SampleSize int //how many requests the percentiles below were computed over
+
+	MinLatency, MaxLatency, MeanLatency time.Duration
+	P50Latency, P90Latency, P99Latency  time.Duration
+}
+
+//createRequestsStats estimates a latency distribution from sample. It
+//only ever sees what ringBufferSink kept in its reservoir, so treat
+//SampleSize against exactStats.Count to know whether that's the whole
+//run or just an estimate.
+func createRequestsStats(sample []requestStat) requestsStats {
+	if len(sample) == 0 {
+		return requestsStats{}
+	}
+	durations := make([]time.Duration, len(sample))
+	var total time.Duration
+	for i, stat := range sample {
+		durations[i] = stat.Duration
+		total += stat.Duration
+	}
+	sort.Slice(durations, func(i, j int) bool { return durations[i] < durations[j] })
+
+	percentile := func(p float64) time.Duration {
+		idx := int(p * float64(len(durations)-1))
+		return durations[idx]
+	}
+
+	return requestsStats{
+		SampleSize:  len(sample),
+		MinLatency:  durations[0],
+		MaxLatency:  durations[len(durations)-1],
+		MeanLatency: total / time.Duration(len(durations)),
+		P50Latency:  percentile(0.50),
+		P90Latency:  percentile(0.90),
+		P99Latency:  percentile(0.99),
+	}
+}
+
+//createTextSummary renders a run's summary. Request count, bytes
+//transferred, throughput, and status/cache tallies come from exact,
+//which ringBufferSink tracks on every Write; reqStats' latency
+//percentiles come from the bounded reservoir sample, so once a run
+//exceeds reservoirCap requests they're labeled as estimates rather than
+//presented as exact figures alongside the exact ones.
+func createTextSummary(reqStats requestsStats, exact exactStats, elapsed time.Duration) string {
+	var b strings.Builder
+
+	fmt.Fprintf(&b, "Requests: %d, Errors: %d, Bytes transferred: %d\n", exact.Count, exact.ErrorCount, exact.DataTransferred)
+	if elapsed > 0 {
+		fmt.Fprintf(&b, "Throughput: %.2f req/s\n", float64(exact.Count)/elapsed.Seconds())
+	}
+
+	codes := make([]int, 0, len(exact.StatusCodes))
+	for code := range exact.StatusCodes {
+		codes = append(codes, code)
+	}
+	sort.Ints(codes)
+	for _, code := range codes {
+		fmt.Fprintf(&b, "  [%d]  %d responses\n", code, exact.StatusCodes[code])
+	}
+
+	if len(exact.CacheStatuses) > 0 {
+		statuses := make([]string, 0, len(exact.CacheStatuses))
+		for status := range exact.CacheStatuses {
+			statuses = append(statuses, status)
+		}
+		sort.Strings(statuses)
+		fmt.Fprint(&b, "Cache: ")
+		for i, status := range statuses {
+			if i > 0 {
+				fmt.Fprint(&b, ", ")
+			}
+			fmt.Fprintf(&b, "%s=%d", status, exact.CacheStatuses[status])
+		}
+		fmt.Fprintf(&b, ", bytes saved=%d\n", exact.BytesSaved)
+	}
+
+	if reqStats.SampleSize == 0 {
+		return strings.TrimRight(b.String(), "\n")
+	}
+	label := "Latency"
+	if reqStats.SampleSize < exact.Count {
+		label = fmt.Sprintf("Latency (estimated from %d of %d requests)", reqStats.SampleSize, exact.Count)
+	}
+	fmt.Fprintf(&b, "%s: min=%s mean=%s p50=%s p90=%s p99=%s max=%s\n",
+		label, reqStats.MinLatency, reqStats.MeanLatency, reqStats.P50Latency, reqStats.P90Latency, reqStats.P99Latency, reqStats.MaxLatency)
+
+	return strings.TrimRight(b.String(), "\n")
+}